@@ -4,34 +4,65 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"embed"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	ginlogger "github.com/gin-contrib/logger"
 	"github.com/gin-gonic/gin"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/jhump/protoreflect/grpcreflect"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/oklog/run"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/sync/errgroup"
+	"github.com/soheilhy/cmux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/xerrors"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
 
+	"github.com/kzmake/grpc-echo/internal/auth"
+	"github.com/kzmake/grpc-echo/internal/observability"
 	pb "github.com/kzmake/greeter/api/greeter/v1"
 )
 
+//go:embed openapi/v1.swagger.json openapi/docs.html
+var openapiFS embed.FS
+
 type Env struct {
 	Address string `default:"0.0.0.0:8080"`
 	Service struct {
 		Address string `default:"greeter.default.svc.cluster.local:50051"`
 	}
-	MTLS bool `default:"true"`
+	MTLS            bool          `default:"true"`
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"5s"`
+
+	Auth struct {
+		Mode string `envconfig:"MODE"`
+
+		JWKSURL      string            `envconfig:"JWKS_URL"`
+		ClaimsToMeta map[string]string `envconfig:"CLAIMS_TO_META"`
+
+		APIKeyHeader string `envconfig:"API_KEY_HEADER" default:"X-API-Key"`
+		APIKey       string `envconfig:"API_KEY"`
+
+		AllowedSANs []string `envconfig:"ALLOWED_SANS"`
+	}
 }
 
 const (
@@ -42,8 +73,12 @@ const (
 )
 
 var (
-	env   Env
-	creds credentials.TransportCredentials
+	env          Env
+	certReloader *CertReloader
+
+	// tracingEnabled follows the standard OTel convention of being gated on
+	// OTEL_EXPORTER_OTLP_ENDPOINT rather than a GATEWAY_-prefixed var.
+	tracingEnabled = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != ""
 )
 
 func init() {
@@ -57,54 +92,324 @@ func init() {
 
 	if env.MTLS {
 		var err error
-		creds, err = loadCreds()
+		certReloader, err = NewCertReloader(crtFile, keyFile, caFile)
 		if err != nil {
 			log.Panic().Msgf("%+v", err)
 		}
 	}
 }
 
-func loadCreds() (credentials.TransportCredentials, error) {
-	cert, err := tls.LoadX509KeyPair(crtFile, keyFile)
+// CertReloader keeps the gateway's mTLS material up to date by watching
+// crtFile, keyFile and caFile on disk and atomically swapping the
+// tls.Certificate/x509.CertPool pair used for both the inbound listener and
+// the outbound gRPC dial credentials. This lets cert-manager/SPIFFE rotate
+// certificates in place without a pod restart.
+type CertReloader struct {
+	crtFile, keyFile, caFile string
+
+	cert atomic.Value // *tls.Certificate
+	pool atomic.Value // *x509.CertPool
+
+	watcher *fsnotify.Watcher
+}
+
+func NewCertReloader(crtFile, keyFile, caFile string) (*CertReloader, error) {
+	r := &CertReloader{crtFile: crtFile, keyFile: keyFile, caFile: caFile}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	w, err := fsnotify.NewWatcher()
 	if err != nil {
-		return nil, xerrors.Errorf("failed to load %s or %s: %w", crtFile, keyFile, err)
+		return nil, xerrors.Errorf("failed to create certificate watcher: %w", err)
 	}
 
-	ca, err := ioutil.ReadFile(caFile)
+	watched := map[string]bool{}
+	for _, f := range []string{crtFile, keyFile, caFile} {
+		dir := filepath.Dir(f)
+		if watched[dir] {
+			continue
+		}
+		if err := w.Add(dir); err != nil {
+			return nil, xerrors.Errorf("failed to watch %s: %w", dir, err)
+		}
+		watched[dir] = true
+	}
+	r.watcher = w
+
+	go r.watch()
+
+	return r, nil
+}
+
+func (r *CertReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.crtFile, r.keyFile)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to load %s: %w", caFile, err)
+		return xerrors.Errorf("failed to load %s or %s: %w", r.crtFile, r.keyFile, err)
+	}
+
+	ca, err := ioutil.ReadFile(r.caFile)
+	if err != nil {
+		return xerrors.Errorf("failed to load %s: %w", r.caFile, err)
 	}
 
 	cp := x509.NewCertPool()
 	if !cp.AppendCertsFromPEM(ca) {
-		return nil, xerrors.Errorf("failed to append certificates")
+		return xerrors.Errorf("failed to append certificates")
 	}
 
-	return credentials.NewTLS(&tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      cp,
-	}), nil
+	r.cert.Store(&cert)
+	r.pool.Store(cp)
+
+	return nil
 }
 
-func newServer(ctx context.Context) (*http.Server, error) {
-	h := runtime.NewServeMux()
-	opts := []grpc.DialOption{}
+func (r *CertReloader) watch() {
+	for {
+		select {
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				log.Error().Msgf("failed to reload mTLS certificates: %+v", err)
+				continue
+			}
+			log.Info().Msg("reloaded mTLS certificates")
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Msgf("certificate watcher error: %v", err)
+		}
+	}
+}
+
+// GetCertificate satisfies tls.Config.GetCertificate for server handshakes.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load().(*tls.Certificate), nil
+}
+
+// GetClientCertificate satisfies tls.Config.GetClientCertificate for the
+// gateway's outbound dial to the greeter service.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.cert.Load().(*tls.Certificate), nil
+}
+
+// CertPool returns the currently loaded CA pool.
+func (r *CertReloader) CertPool() *x509.CertPool {
+	return r.pool.Load().(*x509.CertPool)
+}
+
+// ServerTLSConfig returns a tls.Config for the inbound mTLS listener that
+// always re-reads the current certificate/CA pool via GetConfigForClient,
+// so a rotated CA is honoured on the next handshake.
+func (r *CertReloader) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				GetCertificate: r.GetCertificate,
+				ClientCAs:      r.CertPool(),
+				ClientAuth:     tls.RequireAndVerifyClientCert,
+				NextProtos:     []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}
+}
+
+// dialTransportCredentials wraps credentials.TransportCredentials so the
+// gateway->greeter dial picks up whatever certificate/CA pool the reloader
+// currently holds, rather than the one present at process start.
+type dialTransportCredentials struct {
+	reloader *CertReloader
+}
+
+func (c *dialTransportCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	tlsConfig := &tls.Config{
+		GetClientCertificate: c.reloader.GetClientCertificate,
+		RootCAs:              c.reloader.CertPool(),
+	}
+	return credentials.NewTLS(tlsConfig).ClientHandshake(ctx, authority, rawConn)
+}
+
+func (c *dialTransportCredentials) ServerHandshake(net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, xerrors.Errorf("dialTransportCredentials is client-only")
+}
+
+func (c *dialTransportCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls"}
+}
+
+func (c *dialTransportCredentials) Clone() credentials.TransportCredentials {
+	return &dialTransportCredentials{reloader: c.reloader}
+}
+
+func (c *dialTransportCredentials) OverrideServerName(string) error {
+	return xerrors.Errorf("dialTransportCredentials does not support OverrideServerName")
+}
+
+// healthzHandler probes the upstream greeter service's grpc.health.v1
+// implementation and mirrors its status as a plain HTTP status code, so the
+// same endpoint works for both liveness and readiness probes.
+func healthzHandler(conn *grpc.ClientConn) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+		defer cancel()
+
+		resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		if err != nil {
+			c.String(http.StatusServiceUnavailable, "%v", err)
+			return
+		}
+		if resp.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+			c.String(http.StatusServiceUnavailable, resp.GetStatus().String())
+			return
+		}
+
+		c.String(http.StatusOK, resp.GetStatus().String())
+	}
+}
+
+// reflectHandler asks the upstream's server reflection service for its
+// services and returns their names as JSON; methods are not listed.
+func reflectHandler(conn *grpc.ClientConn) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := grpcreflect.NewClientAuto(c.Request.Context(), conn)
+		defer client.Reset()
+
+		services, err := client.ListServices()
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"services": services})
+	}
+}
+
+type tlsStateContextKey struct{}
+
+// tlsConnectionState unwraps a net.Conn accepted off a cmux-matched listener
+// down to the *tls.Conn cmux buffered bytes from, and returns its
+// ConnectionState. net/http only populates Request.TLS when it can type
+// assert the accepted conn to *tls.Conn directly, which fails for cmux's own
+// *cmux.MuxConn wrapper even though a *tls.Conn is underneath - so that state
+// has to be recovered and reattached by hand via http.Server.ConnContext.
+func tlsConnectionState(c net.Conn) (*tls.ConnectionState, bool) {
+	for {
+		switch v := c.(type) {
+		case *tls.Conn:
+			state := v.ConnectionState()
+			return &state, true
+		case *cmux.MuxConn:
+			c = v.Conn
+		default:
+			return nil, false
+		}
+	}
+}
+
+// recoverTLSState restores Request.TLS from the ConnectionState
+// tlsConnectionState stashed on the request context, undoing the loss
+// described above. Must run before anything (e.g. auth.mtlsMiddleware) that
+// reads Request.TLS.
+func recoverTLSState() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.TLS == nil {
+			if state, ok := c.Request.Context().Value(tlsStateContextKey{}).(*tls.ConnectionState); ok {
+				c.Request.TLS = state
+			}
+		}
+		c.Next()
+	}
+}
+
+// muxedServer answers both grpc.Dial and plain HTTP/JSON requests on a
+// single listener. Incoming connections are told apart by cmux on the
+// "application/grpc" content-type negotiated during the HTTP/2 handshake;
+// everything else falls through to the grpc-gateway/gin handler.
+type muxedServer struct {
+	mux  cmux.CMux
+	grpc *grpc.Server
+	http *http.Server
+
+	grpcL net.Listener
+	httpL net.Listener
+}
+
+// authConfig builds an auth.Config from the env.Auth section; callers treat
+// an empty Mode as "authentication disabled".
+func authConfig() auth.Config {
+	return auth.Config{
+		Mode:         auth.Mode(strings.ToLower(env.Auth.Mode)),
+		JWKSURL:      env.Auth.JWKSURL,
+		ClaimsToMeta: env.Auth.ClaimsToMeta,
+		APIKeyHeader: env.Auth.APIKeyHeader,
+		APIKey:       env.Auth.APIKey,
+		AllowedSANs:  env.Auth.AllowedSANs,
+	}
+}
+
+func newServer(ctx context.Context, lis net.Listener) (*muxedServer, *grpc.ClientConn, error) {
+	m := cmux.New(lis)
+	grpcL := m.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
+	httpL := m.Match(cmux.Any())
+
+	authCfg := authConfig()
+
+	opts := observability.DialOptions(tracingEnabled)
+	opts = append(opts, grpc.WithChainUnaryInterceptor(auth.UnaryClientInterceptor()))
 	if env.MTLS {
-		opts = append(opts, grpc.WithTransportCredentials(creds))
+		opts = append(opts, grpc.WithTransportCredentials(&dialTransportCredentials{reloader: certReloader}))
 	} else {
 		opts = append(opts, grpc.WithInsecure())
 	}
 
-	if err := pb.RegisterGreeterHandlerFromEndpoint(ctx, h, env.Service.Address, opts); err != nil {
-		return nil, xerrors.Errorf("Failed to register handler: %w", err)
+	// Dialed explicitly (rather than via RegisterGreeterHandlerFromEndpoint,
+	// which would hide its own ClientConn) so run() can drain it on shutdown
+	// instead of leaking it when the surrounding context is cancelled, and so
+	// grpcS below has a connection to proxy raw gRPC frames onto.
+	conn, err := grpc.DialContext(ctx, env.Service.Address, opts...)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("failed to dial %s: %w", env.Service.Address, err)
+	}
+
+	// grpcL answers real grpc.Dial clients directly: rather than reimplementing
+	// the Greeter service, every unknown method is transparently forwarded to
+	// conn, so grpcurl/grpc.Dial against env.Address behaves exactly like
+	// dialing the upstream directly. The stream interceptor enforces authCfg
+	// the same way auth.Middleware does for the REST path below - without it
+	// a grpc.Dial client could reach the upstream through this listener with
+	// no authentication at all.
+	grpcS := grpc.NewServer(
+		grpc.CustomCodec(proxy.Codec()),
+		grpc.ChainStreamInterceptor(auth.StreamServerInterceptor(authCfg)),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(func(ctx context.Context, _ string) (context.Context, *grpc.ClientConn, error) {
+			return ctx, conn, nil
+		})),
+	)
+
+	h := runtime.NewServeMux(observability.Annotator(), auth.Annotator(), auth.ErrorHandler())
+	if err := pb.RegisterGreeterHandler(ctx, h, conn); err != nil {
+		return nil, nil, xerrors.Errorf("Failed to register handler: %w", err)
+	}
+
+	openapiDocs, err := fs.Sub(openapiFS, "openapi")
+	if err != nil {
+		return nil, nil, xerrors.Errorf("failed to open embedded openapi docs: %w", err)
 	}
 
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 
+	r.Use(recoverTLSState())
 	r.Use(ginlogger.SetLogger(
 		ginlogger.WithLogger(func(c *gin.Context, _ io.Writer, latency time.Duration) zerolog.Logger {
-			return log.Logger.With().
+			return observability.EnrichLogger(c.Request.Context(), log.Logger.With()).
 				Timestamp().
 				Int("status", c.Writer.Status()).
 				Str("method", c.Request.Method).
@@ -117,45 +422,127 @@ func newServer(ctx context.Context) (*http.Server, error) {
 		ginlogger.WithSkipPath([]string{"*"}),
 	))
 	r.Use(gin.Recovery())
+	r.Use(observability.GinMiddleware("gateway", tracingEnabled)...)
+
+	r.GET("/openapi.json", func(c *gin.Context) { c.FileFromFS("v1.swagger.json", http.FS(openapiDocs)) })
+	r.StaticFS("/openapi", http.FS(openapiDocs))
+	r.GET("/docs", func(c *gin.Context) { c.FileFromFS("docs.html", http.FS(openapiDocs)) })
+	r.GET("/healthz", healthzHandler(conn))
+	r.GET("/readyz", healthzHandler(conn))
+	r.GET("/reflect", reflectHandler(conn))
+	r.GET("/metrics", observability.MetricsHandler())
 
+	r.Use(auth.Middleware(authCfg))
 	r.Any("/*any", gin.WrapH(h))
 
-	return &http.Server{Addr: env.Address, Handler: r}, nil
+	// h2c lets plain (non-TLS) clients negotiate HTTP/2 on the muxed
+	// listener too; when env.MTLS is set the listener is already wrapped
+	// in tls.Server and ALPN does the negotiation instead.
+	httpS := &http.Server{
+		Handler: h2c.NewHandler(r, &http2.Server{}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if state, ok := tlsConnectionState(c); ok {
+				ctx = context.WithValue(ctx, tlsStateContextKey{}, state)
+			}
+			return ctx
+		},
+	}
+
+	return &muxedServer{
+		mux:   m,
+		grpc:  grpcS,
+		http:  httpS,
+		grpcL: grpcL,
+		httpL: httpL,
+	}, conn, nil
 }
 
-func run() error {
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// muxServeErr filters the "use of closed network connection" error cmux
+// always returns once its listener is closed during shutdown, so it doesn't
+// get mistaken for an actual serve failure.
+func muxServeErr(err error) error {
+	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		return err
+	}
+	return nil
+}
 
-	g, ctx := errgroup.WithContext(ctx)
+func run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	gatewayS, err := newServer(ctx)
+	lis, err := net.Listen("tcp", env.Address)
 	if err != nil {
-		log.Fatal().Msgf("Failed to build gateway server: %v", err)
+		log.Fatal().Msgf("Failed to listen on %s: %v", env.Address, err)
+	}
+	if env.MTLS {
+		lis = tls.NewListener(lis, certReloader.ServerTLSConfig())
 	}
-	g.Go(func() error { return gatewayS.ListenAndServe() })
-
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	defer signal.Stop(quit)
 
-	select {
-	case <-quit:
-		break
-	case <-ctx.Done():
-		break
+	gatewayS, conn, err := newServer(ctx, lis)
+	if err != nil {
+		log.Fatal().Msgf("Failed to build gateway server: %v", err)
 	}
 
-	cancel()
+	// A run.Group actor per component shares one cancellation: whichever
+	// actor returns first (a listener erroring, or the signal context being
+	// cancelled) triggers every other actor's interrupt function, so the
+	// gRPC server, the HTTP server and cmux itself always stop together.
+	// run.Group runs interrupt functions sequentially in Add order, so mux is
+	// added first - closing it stops new connections from being accepted
+	// before either protocol starts draining its in-flight ones, instead of
+	// after, which would let new work in the whole time draining is happening.
+	var g run.Group
+
+	g.Add(func() error {
+		return muxServeErr(gatewayS.mux.Serve())
+	}, func(error) {
+		gatewayS.mux.Close()
+	})
+
+	g.Add(func() error {
+		return gatewayS.grpc.Serve(gatewayS.grpcL)
+	}, func(error) {
+		// GracefulStop blocks until every in-flight call (including ones held
+		// open by the transparent proxy) finishes, with no timeout of its
+		// own, so race it against env.ShutdownTimeout the same way the HTTP
+		// actor below does and fall back to a hard Stop.
+		stopped := make(chan struct{})
+		go func() {
+			gatewayS.grpc.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(env.ShutdownTimeout):
+			log.Warn().Msg("gRPC graceful stop timed out, forcing Stop")
+			gatewayS.grpc.Stop()
+			<-stopped
+		}
+	})
+
+	g.Add(func() error {
+		return gatewayS.http.Serve(gatewayS.httpL)
+	}, func(error) {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), env.ShutdownTimeout)
+		defer cancel()
+		if err := gatewayS.http.Shutdown(shutdownCtx); err != nil {
+			log.Error().Msgf("failed to drain in-flight HTTP requests: %v", err)
+		}
+	})
 
-	log.Info().Msg("Shutting down server...")
+	g.Add(func() error {
+		<-ctx.Done()
+		log.Info().Msg("Shutting down server...")
+		return ctx.Err()
+	}, func(error) {})
 
-	ctx, timeout := context.WithTimeout(context.Background(), 5*time.Second)
-	defer timeout()
+	if err := g.Run(); err != nil && !xerrors.Is(err, context.Canceled) {
+		log.Error().Msgf("server exited: %v", err)
+	}
 
-	if err := gatewayS.Shutdown(ctx); err != nil {
-		return xerrors.Errorf("failed to shutdown: %w", err)
+	if err := conn.Close(); err != nil {
+		return xerrors.Errorf("failed to close upstream connection: %w", err)
 	}
 
 	log.Info().Msgf("Server exiting")
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed cert/key pair into dir and returns the
+// cert, key and CA (the same cert, since it's self-signed) file paths.
+func writeTestCert(t *testing.T, dir string) (crtFile, keyFile, caFile string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gateway-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	crtPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	crtFile = filepath.Join(dir, "client.gateway.crt")
+	keyFile = filepath.Join(dir, "client.gateway.key")
+	caFile = filepath.Join(dir, "ca.crt")
+
+	if err := os.WriteFile(crtFile, crtPEM, 0o600); err != nil {
+		t.Fatalf("failed to write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	if err := os.WriteFile(caFile, crtPEM, 0o600); err != nil {
+		t.Fatalf("failed to write ca: %v", err)
+	}
+
+	return crtFile, keyFile, caFile
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	crtFile, keyFile, caFile := writeTestCert(t, t.TempDir())
+
+	r := &CertReloader{crtFile: crtFile, keyFile: keyFile, caFile: caFile}
+
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload() failed on valid material: %v", err)
+	}
+	if r.cert.Load() == nil {
+		t.Error("reload() did not store a certificate")
+	}
+	if r.pool.Load() == nil {
+		t.Error("reload() did not store a CA pool")
+	}
+}
+
+func TestCertReloaderReloadMissingFiles(t *testing.T) {
+	r := &CertReloader{
+		crtFile: "testdata/does-not-exist.crt",
+		keyFile: "testdata/does-not-exist.key",
+		caFile:  "testdata/does-not-exist-ca.crt",
+	}
+
+	if err := r.reload(); err == nil {
+		t.Fatal("reload() succeeded with missing certificate material, want error")
+	}
+}
+
+func TestCertReloaderReloadBadCA(t *testing.T) {
+	dir := t.TempDir()
+	crtFile, keyFile, _ := writeTestCert(t, dir)
+
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caFile, []byte("not a pem certificate"), 0o600); err != nil {
+		t.Fatalf("failed to write bad ca: %v", err)
+	}
+
+	r := &CertReloader{crtFile: crtFile, keyFile: keyFile, caFile: caFile}
+
+	if err := r.reload(); err == nil {
+		t.Fatal("reload() succeeded with an invalid CA file, want error")
+	}
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/url"
+	"testing"
+)
+
+func TestAnyAllowed(t *testing.T) {
+	allowed := map[string]bool{
+		"svc.example.com":         true,
+		"spiffe://cluster/ns/svc": true,
+	}
+
+	cases := []struct {
+		name string
+		cert *x509.Certificate
+		want bool
+	}{
+		{"dns san matches", &x509.Certificate{DNSNames: []string{"svc.example.com"}}, true},
+		{"uri san matches", &x509.Certificate{URIs: []*url.URL{mustParseURL(t, "spiffe://cluster/ns/svc")}}, true},
+		{"dns san not allowed", &x509.Certificate{DNSNames: []string{"other.example.com"}}, false},
+		{"uri san not allowed", &x509.Certificate{URIs: []*url.URL{mustParseURL(t, "spiffe://cluster/ns/other")}}, false},
+		{"no sans at all", &x509.Certificate{}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := anyAllowed(allowed, tc.cert); got != tc.want {
+				t.Errorf("anyAllowed() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", s, err)
+	}
+	return u
+}
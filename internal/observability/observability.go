@@ -0,0 +1,137 @@
+// Package observability wires request IDs, Prometheus metrics and
+// OpenTelemetry tracing into the gateway's gin engine and its outgoing gRPC
+// dial, so a single import gets a service to correlated logs/metrics/traces.
+package observability
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	grpcprom "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestIDHeader is the header inspected and (if absent) generated on every
+// inbound request, and forwarded as gRPC metadata so the upstream call can
+// be correlated with the edge access log.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// RequestID ensures every request carries a RequestIDHeader, generating one
+// when the caller didn't send it, and stores it on the request context so
+// downstream handlers and the gateway->upstream gRPC call can pick it up.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" {
+			id = uuid.NewString()
+		}
+		c.Writer.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(c.Request.Context(), requestIDKey{}, id)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// Annotator returns a runtime.ServeMuxOption that forwards the request ID
+// set by RequestID as outgoing gRPC metadata, so the upstream call can be
+// correlated with the edge access log that handled it. It reads the ID off
+// ctx (which is req.Context(), so it carries whatever RequestID stored there)
+// rather than the raw header, since RequestID only ever writes a generated
+// ID to the response header, not back onto the incoming request.
+func Annotator() runtime.ServeMuxOption {
+	return runtime.WithMetadata(func(ctx context.Context, _ *http.Request) metadata.MD {
+		if id, ok := ctx.Value(requestIDKey{}).(string); ok && id != "" {
+			return metadata.Pairs(RequestIDHeader, id)
+		}
+		return nil
+	})
+}
+
+// DialOptions returns the client-side interceptors that make the
+// gateway->upstream connection observable: Prometheus client metrics
+// (counters plus, via EnableClientHandlingTimeHistogram, a handling-time
+// histogram) and, when tracingEnabled, OTel span propagation.
+func DialOptions(tracingEnabled bool) []grpc.DialOption {
+	grpcprom.EnableClientHandlingTimeHistogram()
+
+	opts := []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(grpcprom.UnaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(grpcprom.StreamClientInterceptor),
+	}
+	if tracingEnabled {
+		opts = append(opts,
+			grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+			grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()),
+		)
+	}
+	return opts
+}
+
+// requestDuration is a per-route/method/status histogram of how long the gin
+// engine took to handle a request, registered on the default Prometheus
+// registry so it's exposed alongside the grpc-ecosystem client metrics by
+// MetricsHandler.
+var requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "gateway_http_request_duration_seconds",
+	Help: "Duration of HTTP requests served by the gateway, by route, method and status.",
+}, []string{"route", "method", "status"})
+
+func init() {
+	prometheus.MustRegister(requestDuration)
+}
+
+// requestMetrics records each request's latency into requestDuration.
+func requestMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		requestDuration.WithLabelValues(c.FullPath(), c.Request.Method, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// GinMiddleware returns the gin middleware stack this package contributes:
+// request ID propagation, per-route duration histograms, and (when
+// tracingEnabled) OTel span creation per route.
+func GinMiddleware(serviceName string, tracingEnabled bool) []gin.HandlerFunc {
+	mw := []gin.HandlerFunc{RequestID(), requestMetrics()}
+	if tracingEnabled {
+		mw = append(mw, otelgin.Middleware(serviceName))
+	}
+	return mw
+}
+
+// MetricsHandler is the gin handler for the /metrics route, exposing the
+// default Prometheus registry: the grpc-ecosystem client metrics recorded by
+// DialOptions' interceptors, requestDuration, and the Go runtime and process
+// collectors.
+func MetricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// EnrichLogger adds trace_id/span_id fields (when a span is active on ctx)
+// and the request ID (when RequestID ran) to a zerolog context, so access
+// logs, traces and metrics can be correlated by request.
+func EnrichLogger(ctx context.Context, ev zerolog.Context) zerolog.Context {
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		ev = ev.Str("trace_id", span.TraceID().String()).Str("span_id", span.SpanID().String())
+	}
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		ev = ev.Str("request_id", id)
+	}
+	return ev
+}